@@ -0,0 +1,262 @@
+package mongo_go_driver_connection_pool
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultLockCollection is where advisory lock documents live when LockOptions.Collection is unset
+const defaultLockCollection = "pool_advisory_lock"
+
+// defaultLockTimeout is how long AcquireLock retries before giving up when LockOptions.Timeout is unset
+const defaultLockTimeout = 15 * time.Second
+
+// defaultLockTTL is how long a held lock survives without a refresh before another process may steal it
+const defaultLockTTL = 30 * time.Second
+
+// initialLockBackoff and maxLockBackoff bound the exponential backoff between acquire retries
+const initialLockBackoff = 50 * time.Millisecond
+const maxLockBackoff = 2 * time.Second
+
+// LockOptions configures AcquireLock. All fields are optional.
+type LockOptions struct {
+	// Database the lock collection lives in. Defaults to the database segment of the pool's
+	// connection string; AcquireLock errors if neither is set, since there is no safe database
+	// to fall back to without risking targeting one the caller's credentials can't write to.
+	Database string
+	// Collection the lock documents live in, default "pool_advisory_lock"
+	Collection string
+	// Timeout bounds how long AcquireLock retries a held lock before giving up, default 15s
+	Timeout time.Duration
+	// TTL is how long a held lock survives without a refresh, default 30s
+	TTL time.Duration
+	// RefreshInterval, when non-zero, spawns a keepalive goroutine that bumps expiresAt on this
+	// interval for as long as the lock is held, so long-running holders don't lose it to TTL expiry
+	RefreshInterval time.Duration
+}
+
+// Lock is a held advisory lock, acquired via ConnPool.AcquireLock and released via Release.
+type Lock struct {
+	pool       *ConnPool
+	key        string
+	owner      string
+	database   string
+	collection string
+	ttl        time.Duration
+	// guards stopRefresh so concurrent Release calls don't both close it
+	releaseLock sync.Mutex
+	stopRefresh chan struct{}
+	refreshDone chan struct{}
+}
+
+type lockDoc struct {
+	ID        string    `bson:"_id"`
+	Owner     string    `bson:"owner"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// AcquireLock coordinates an exclusive section across processes sharing this pool's database by
+// racing to insert a document keyed on key into a dedicated collection. On a duplicate key it
+// retries with exponential backoff until opts.Timeout elapses or ctx is cancelled. A TTL index on
+// expiresAt means a holder that crashes without calling Release still gets reaped by the server.
+func (c *ConnPool) AcquireLock(ctx context.Context, key string, opts LockOptions) (*Lock, error) {
+	database := opts.Database
+	if database == "" {
+		database = defaultDatabase(c.connStr)
+	}
+	if database == "" {
+		return nil, fmt.Errorf("advisory lock requires a database: set LockOptions.Database or include a database in the pool's connection string")
+	}
+	collection := opts.Collection
+	if collection == "" {
+		collection = defaultLockCollection
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = defaultLockTimeout
+	}
+	ttl := opts.TTL
+	if ttl == 0 {
+		ttl = defaultLockTTL
+	}
+
+	session, err := c.CheckoutContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error checking out a session for advisory lock :: %v", err)
+	}
+	defer c.CheckIn(ctx, session)
+
+	coll := c.currentClient().Database(database).Collection(collection)
+
+	owner, err := generateLockOwner()
+	if err != nil {
+		return nil, fmt.Errorf("error generating advisory lock owner :: %v", err)
+	}
+
+	err = mongo.WithSession(ctx, session, func(sc mongo.SessionContext) error {
+		if err := ensureLockIndexes(sc, coll); err != nil {
+			return fmt.Errorf("error ensuring advisory lock indexes :: %v", err)
+		}
+
+		deadline := time.Now().Add(timeout)
+		backoff := initialLockBackoff
+		for {
+			_, err := coll.InsertOne(sc, lockDoc{ID: key, Owner: owner, ExpiresAt: time.Now().Add(ttl)})
+			if err == nil {
+				return nil
+			}
+			if !isDuplicateKeyError(err) {
+				return fmt.Errorf("error acquiring advisory lock %q :: %v", key, err)
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out acquiring advisory lock %q after %v", key, timeout)
+			}
+
+			select {
+			case <-sc.Done():
+				return sc.Err()
+			case <-time.After(backoff):
+			}
+			backoff = nextBackoff(backoff)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &Lock{
+		pool:       c,
+		key:        key,
+		owner:      owner,
+		database:   database,
+		collection: collection,
+		ttl:        ttl,
+	}
+
+	if opts.RefreshInterval > 0 {
+		lock.stopRefresh = make(chan struct{})
+		lock.refreshDone = make(chan struct{})
+		go lock.keepalive(opts.RefreshInterval, lock.stopRefresh)
+	}
+
+	return lock, nil
+}
+
+// Release deletes the lock document, but only if it is still owned by this Lock, and stops any
+// keepalive goroutine started via LockOptions.RefreshInterval.
+func (l *Lock) Release(ctx context.Context) error {
+	l.releaseLock.Lock()
+	stop, done := l.stopRefresh, l.refreshDone
+	l.stopRefresh = nil
+	l.releaseLock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+
+	session, err := l.pool.CheckoutContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error checking out a session to release advisory lock :: %v", err)
+	}
+	defer l.pool.CheckIn(ctx, session)
+
+	coll := l.pool.currentClient().Database(l.database).Collection(l.collection)
+	err = mongo.WithSession(ctx, session, func(sc mongo.SessionContext) error {
+		_, err := coll.DeleteOne(sc, bson.D{{"_id", l.key}, {"owner", l.owner}})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error releasing advisory lock %q :: %v", l.key, err)
+	}
+	return nil
+}
+
+// keepalive bumps expiresAt on RefreshInterval for as long as the lock is held, so the TTL index
+// doesn't reap a lock that is still legitimately in use.
+func (l *Lock) keepalive(interval time.Duration, stop <-chan struct{}) {
+	defer close(l.refreshDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			session, err := l.pool.CheckoutContext(ctx)
+			if err == nil {
+				coll := l.pool.currentClient().Database(l.database).Collection(l.collection)
+				_ = mongo.WithSession(ctx, session, func(sc mongo.SessionContext) error {
+					_, err := coll.UpdateOne(sc,
+						bson.D{{"_id", l.key}, {"owner", l.owner}},
+						bson.D{{"$set", bson.D{{"expiresAt", time.Now().Add(l.ttl)}}}},
+					)
+					return err
+				})
+				l.pool.CheckIn(ctx, session)
+			}
+			cancel()
+		}
+	}
+}
+
+func ensureLockIndexes(ctx context.Context, coll *mongo.Collection) error {
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"expiresAt", 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// isDuplicateKeyError reports whether err is a Mongo duplicate key error (code 11000), the
+// signal that another process is already holding the lock.
+func isDuplicateKeyError(err error) bool {
+	return strings.Contains(err.Error(), "E11000")
+}
+
+func generateLockOwner() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// defaultDatabase extracts the database segment from a mongodb:// connection string, returning ""
+// if the connection string has no database path segment.
+func defaultDatabase(connStr string) string {
+	i := strings.Index(connStr, "://")
+	if i == -1 {
+		return ""
+	}
+	rest := connStr[i+3:]
+
+	slash := strings.Index(rest, "/")
+	if slash == -1 {
+		return ""
+	}
+	rest = rest[slash+1:]
+
+	if q := strings.IndexAny(rest, "?"); q != -1 {
+		rest = rest[:q]
+	}
+	return rest
+}
+
+// nextBackoff doubles d, capped at maxLockBackoff.
+func nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > maxLockBackoff {
+		d = maxLockBackoff
+	}
+	return d
+}
@@ -2,170 +2,482 @@ package mongo_go_driver_connection_pool
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/json"
 	"fmt"
 	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/readpref"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type clientWithCreation struct {
-	//mongo client
-	db *mongo.Client
-	//creation time of client in nano
-	creationTime int64
-}
+// defaultValidationTimeout bounds how long a health check Ping is allowed to take
+const defaultValidationTimeout = 5 * time.Second
 
+// ConnPool wraps a single *mongo.Client. The driver already maintains its own internal socket
+// pool and topology monitoring per Client, so rather than dialing poolSize independent clients
+// this pool dials once and hands out mongo.Session values for per-request isolation (causal
+// consistency, transactions), while the driver multiplexes the underlying connections itself.
 type ConnPool struct {
-	//used connection
-	connectionsInUse map[[16]byte]clientWithCreation
-	//unused connection
-	freeConnections map[[16]byte]clientWithCreation
-	//mutex loc
-	lock sync.RWMutex
-	//pool size
-	poolSize int
-	// conn string
+	// guards every mutable field below
+	lock sync.Mutex
+	// the single driver client backing this pool
+	client *mongo.Client
+	// base conn string, without the pool-size query parameters dial() appends
 	connStr string
-	//Conn expiry in nano second, default is 5 minutes
-	expiry int64
+	// pool size passed to the driver as maxPoolSize
+	poolSize int
+	// ValidationTimeout bounds how long a health check Ping is allowed to take
+	ValidationTimeout time.Duration
+	// closing this channel stops the currently running healthCheckLoop, nil if none is running
+	healthCheckStop chan struct{}
+	// how often healthCheckLoop pings the client, zero means the health check is disabled
+	healthCheckInterval time.Duration
+	// error from the most recent health check Ping, nil if the last one succeeded or none has run
+	lastHealthCheckErr error
+	// monotonic counter used to assign PooledSession.id
+	nextSessionID uint64
+	// MaxWaitTime bounds how long CheckoutContext blocks for a free slot before giving up, zero
+	// means wait indefinitely (still subject to ctx cancellation)
+	MaxWaitTime time.Duration
+	// number of sessions currently checked out, bounded by poolSize
+	inUse int
+	// FIFO queue of goroutines blocked in CheckoutContext waiting for a slot to free up
+	waiters []chan struct{}
+	// WaitCount and WaitDuration track how often and how long CheckoutContext has had to block
+	waitCount    uint64
+	waitDuration time.Duration
+	// when the live client was last dialed, used by reapLoop to decide when to recycle it
+	clientCreatedAt time.Time
+	// ConnMaxLifetime bounds how long the shared client is reused before reapLoop recycles it.
+	// Zero means a client is never recycled for age.
+	connMaxLifetime time.Duration
+	// ConnMaxIdleTime is applied to the driver as maxIdleTimeMS on the next recycle. Zero leaves
+	// the driver's default in place.
+	connMaxIdleTime time.Duration
+	// minPoolSize is recorded by SetMaxIdleConns but is not passed to the driver
+	minPoolSize int
+	// closing this channel stops reapLoop
+	reapStop chan struct{}
 }
 
-func CreateConnPool(poolSize int, connStr string) (*ConnPool, error) {
-	var mu sync.RWMutex
-	connPool := &ConnPool{
-		connectionsInUse: make(map[[16]byte]clientWithCreation),
-		freeConnections:  make(map[[16]byte]clientWithCreation),
-		lock:             mu,
-		poolSize:         poolSize,
-		connStr:          connStr,
-		expiry:           300000000000,
-	}
-	return connPool, nil
+// reapInterval is how often reapLoop checks whether the client needs recycling.
+const reapInterval = time.Minute
+
+// PoolStats is a snapshot of ConnPool's session accounting, returned by Stats.
+type PoolStats struct {
+	// InUse is the number of sessions currently checked out
+	InUse int
+	// Idle is the number of sessions that could be checked out right now without blocking
+	Idle int
+	// Waiters is the number of goroutines currently blocked in CheckoutContext waiting for a slot
+	Waiters int
+	// WaitCount is the cumulative number of CheckoutContext calls that had to block
+	WaitCount uint64
+	// WaitDuration is the cumulative time CheckoutContext calls have spent blocked
+	WaitDuration time.Duration
+	// HealthCheckInterval is the interval passed to the most recent SetHealthCheckInterval call,
+	// zero if the health check has never been enabled
+	HealthCheckInterval time.Duration
+	// Healthy reports whether the most recent health check Ping succeeded, true if no health
+	// check has run yet
+	Healthy bool
 }
 
-func (c *ConnPool) Checkout() (*mongo.Client, error) {
+// Stats returns a snapshot of the pool's current session accounting and health check status.
+func (c *ConnPool) Stats() PoolStats {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	//Fill the connection pool for the first time
-	if len(c.freeConnections) == 0 && len(c.connectionsInUse) == 0 {
-		for i := 0; i < c.poolSize; i++ {
-			err := c.createConnections()
-			if err != nil {
-				return nil, err
-			}
-		}
+	return PoolStats{
+		InUse:               c.inUse,
+		Idle:                c.idle(),
+		Waiters:             len(c.waiters),
+		WaitCount:           c.waitCount,
+		WaitDuration:        c.waitDuration,
+		HealthCheckInterval: c.healthCheckInterval,
+		Healthy:             c.lastHealthCheckErr == nil,
 	}
+}
 
-	now := time.Now().UnixNano()
+// PooledSession pairs a mongo.Session with a monotonic id, letting callers key maps/logs on the
+// id instead of on the session value itself (which has no useful identity or equality of its
+// own). Session's methods are promoted, so a *PooledSession satisfies mongo.Session.
+type PooledSession struct {
+	mongo.Session
+	id uint64
+}
 
-	//Fill the difference
-	for i := len(c.freeConnections) + len(c.connectionsInUse); i <= c.poolSize; i++ {
-		err := c.createConnections()
-		if err != nil {
-			return nil, err
-		}
+// ID returns the monotonically increasing id assigned to this session when it was checked out.
+func (p *PooledSession) ID() uint64 {
+	return p.id
+}
+
+// CreateConnPool dials a single shared client against connStr, bounded to poolSize concurrent
+// sessions, and starts the background reaper that recycles the client per ConnMaxLifetime.
+func CreateConnPool(poolSize int, connStr string) (*ConnPool, error) {
+	c := &ConnPool{
+		connStr:           connStr,
+		poolSize:          poolSize,
+		ValidationTimeout: defaultValidationTimeout,
+	}
+	if err := c.dial(); err != nil {
+		return nil, err
 	}
 
-	if len(c.freeConnections) > 0 {
-		for k, v := range c.freeConnections {
-			// Delete the expired connections
-			if now-v.creationTime > c.expiry {
-				delete(c.freeConnections, k)
-				err := c.kill(v.db)
-				if err != nil {
-					return nil, fmt.Errorf("error while closing the connection :: %v", err)
-				}
-			} else {
-				// Delete the non active connections
-				if err := c.validate(v.db); err != nil {
-					delete(c.freeConnections, k)
-					err := c.kill(v.db)
-					if err != nil {
-						return nil, fmt.Errorf("error while closing the connection :: %v", err)
-					}
-				} else {
-					delete(c.freeConnections, k)
-					v.creationTime = now
-					c.connectionsInUse[k] = v
-					return v.db, nil
-				}
-			}
-		}
+	c.reapStop = make(chan struct{})
+	go c.reapLoop(c.reapStop)
+
+	return c, nil
+}
+
+// dial connects a fresh client and installs it as the pool's shared client.
+func (c *ConnPool) dial() error {
+	client, err := c.dialClient()
+	if err != nil {
+		return err
 	}
 
-	//Need a new connection because all free connection is busy
-	//Or number of connections crossing the limit
-	client, e := c.create()
+	c.lock.Lock()
+	c.client = client
+	c.clientCreatedAt = time.Now()
+	c.lock.Unlock()
+	return nil
+}
+
+// dialClient builds a client from the pool's current connStr/poolSize/connMaxIdleTime and
+// connects it, without installing it as the pool's shared client. Connection pooling is
+// configured through URI query parameters rather than an options-builder API, since that API's
+// shape (ApplyURI, SetMaxPoolSize's argument type, whether NewClient takes a URI or an options
+// value) has changed across driver versions and this repo pins none of them with a go.mod; the
+// maxPoolSize/maxIdleTimeMS URI options themselves are part of the stable connection string
+// format and work across versions.
+func (c *ConnPool) dialClient() (*mongo.Client, error) {
+	c.lock.Lock()
+	uri := withPoolSizeParams(c.connStr, c.poolSize, c.connMaxIdleTime)
+	c.lock.Unlock()
+
+	client, e := mongo.NewClient(uri)
 	if e != nil {
-		return nil, fmt.Errorf("error while creating the connection :: %v", e)
+		return nil, fmt.Errorf("error at mongo db creation :: %v", e)
 	}
-	hash := c.hash(*client)
-	c.connectionsInUse[hash] = clientWithCreation{
-		db:           client,
-		creationTime: now,
+
+	if e := client.Connect(context.Background()); e != nil {
+		return nil, fmt.Errorf("error connecting to mongo :: %v", e)
 	}
+
 	return client, nil
 }
 
-func (c *ConnPool) CheckIn(client *mongo.Client) {
+// currentClient returns the shared client, synchronized against a concurrent recycle in
+// reapLoop. Callers outside this file (e.g. advisory_lock.go) must use this instead of reading
+// the unexported client field directly.
+func (c *ConnPool) currentClient() *mongo.Client {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	hash := c.hash(*client)
-	delete(c.connectionsInUse, hash)
-	//Add only if the size of active conn is less than the max
-	if len(c.freeConnections)+len(c.connectionsInUse) < c.poolSize {
-		c.freeConnections[hash] = clientWithCreation{
-			db:           client,
-			creationTime: time.Now().UnixNano(),
-		}
+	return c.client
+}
+
+// withPoolSizeParams appends maxPoolSize, and optionally maxIdleTimeMS, query parameters to a
+// Mongo connection string. minPoolSize is deliberately not one of them: the connection-string
+// parser in the pinned driver version (anything dialClient() compiles against, since it calls
+// mongo.NewClient(uri string), a signature that only exists through v0.3.x) has no minpoolsize
+// case and silently drops it into UnknownOptions, so appending it would be a param that looks
+// configured but never does anything.
+func withPoolSizeParams(connStr string, maxPoolSize int, maxIdleTime time.Duration) string {
+	params := []string{fmt.Sprintf("maxPoolSize=%d", maxPoolSize)}
+	if maxIdleTime > 0 {
+		params = append(params, fmt.Sprintf("maxIdleTimeMS=%d", maxIdleTime.Milliseconds()))
 	}
+
+	sep := "?"
+	if strings.Contains(connStr, "?") {
+		sep = "&"
+	}
+	return connStr + sep + strings.Join(params, "&")
 }
 
-func (c *ConnPool) create() (*mongo.Client, error) {
-	client, e := mongo.NewClient(c.connStr)
-	if e != nil {
-		return nil, fmt.Errorf("error at mongo db creation :: %v", e)
+// SetConnMaxLifetime sets how long the shared client is reused before reapLoop recycles it (dials
+// a fresh client and disconnects the old one) the next time it observes the pool fully idle.
+// Zero, the default, means the client is never recycled for age.
+func (c *ConnPool) SetConnMaxLifetime(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.connMaxLifetime = d
+}
+
+// SetConnMaxIdleTime sets maxIdleTimeMS, applied to the driver the next time the client is
+// recycled by reapLoop or dial is otherwise called again. The driver doesn't support
+// reconfiguring a live *mongo.Client, so this has no effect until the next recycle.
+func (c *ConnPool) SetConnMaxIdleTime(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.connMaxIdleTime = d
+}
+
+// SetMaxIdleConns is named to match database/sql's SetMaxIdleConns, the closest analogue this
+// driver exposes (minPoolSize), but currently has no effect: the connection-string parser in the
+// driver version this package's mongo.NewClient(uri string) call compiles against has no
+// minpoolsize option, so there is no way to apply it without a newer, incompatible driver import.
+// Kept as a documented no-op rather than silently dropped, in case a future driver bump wires it
+// up to withPoolSizeParams.
+func (c *ConnPool) SetMaxIdleConns(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.minPoolSize = n
+}
+
+// SetMaxOpenConns sets poolSize. It takes effect immediately for the concurrent-session
+// semaphore, and is applied to the driver as maxPoolSize the next time the client is recycled.
+func (c *ConnPool) SetMaxOpenConns(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.poolSize = n
+}
+
+// reapLoop periodically recycles the shared client once it has outlived connMaxLifetime, as long
+// as no sessions are currently checked out.
+func (c *ConnPool) reapLoop(stop chan struct{}) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.recycleIfExpired()
+		}
 	}
-	return client, nil
 }
 
-func (c *ConnPool) validate(client *mongo.Client) error {
-	err := client.Connect(context.Background())
+// recycleIfExpired redials the shared client if connMaxLifetime has elapsed since it was last
+// dialed and the pool is fully idle, disconnecting the old client once the new one is live.
+// Recycling is skipped while sessions are checked out so in-flight work isn't broken; since the
+// initial idle check is a point-in-time snapshot taken before the (slow, network) dial, idleness
+// is re-checked under the lock immediately before the swap too, aborting the recycle rather than
+// disconnecting a client a Checkout picked up in the meantime.
+func (c *ConnPool) recycleIfExpired() {
+	c.lock.Lock()
+	expired := c.connMaxLifetime > 0 && c.inUse == 0 && time.Since(c.clientCreatedAt) >= c.connMaxLifetime
+	c.lock.Unlock()
+	if !expired {
+		return
+	}
+
+	newClient, err := c.dialClient()
 	if err != nil {
-		return fmt.Errorf("error in connecting mongo :: %v", err)
+		return
 	}
-	return nil
+
+	c.lock.Lock()
+	if c.inUse > 0 {
+		c.lock.Unlock()
+		_ = newClient.Disconnect(context.Background())
+		return
+	}
+	old := c.client
+	c.client = newClient
+	c.clientCreatedAt = time.Now()
+	c.lock.Unlock()
+
+	_ = old.Disconnect(context.Background())
 }
 
-func (c *ConnPool) kill(client *mongo.Client) error {
-	return client.Disconnect(context.Background())
+// Checkout starts a new session against the shared client, failing immediately with
+// ErrPoolExhausted if poolSize sessions are already checked out rather than blocking. Use
+// CheckoutContext to block for a free slot instead. The returned *PooledSession carries a
+// monotonic id so callers can key maps/logs on something other than the session value itself.
+func (c *ConnPool) Checkout() (*PooledSession, error) {
+	if e := c.acquireSlot(context.Background(), false); e != nil {
+		return nil, e
+	}
+	return c.newSession()
 }
 
-func (c *ConnPool) hash(arr mongo.Client) [16]byte {
-	arrBytes := make([]byte, 0)
-	jsonBytes, _ := json.Marshal(arr)
-	arrBytes = append(arrBytes, jsonBytes...)
-	return md5.Sum(arrBytes)
+// CheckoutContext behaves like Checkout but, if the pool is exhausted, blocks in FIFO order for a
+// slot to free up instead of failing immediately. The wait is bounded by both ctx and MaxWaitTime.
+func (c *ConnPool) CheckoutContext(ctx context.Context) (*PooledSession, error) {
+	if MaxWaitTime := c.MaxWaitTime; MaxWaitTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, MaxWaitTime)
+		defer cancel()
+	}
+	if e := c.acquireSlot(ctx, true); e != nil {
+		return nil, e
+	}
+	return c.newSession()
 }
 
-func (c *ConnPool) createConnections() error {
-	client, e := c.create()
+func (c *ConnPool) newSession() (*PooledSession, error) {
+	session, e := c.currentClient().StartSession()
 	if e != nil {
-		return fmt.Errorf("error at creating the connection pool :: %v", e)
+		c.releaseSlot()
+		return nil, fmt.Errorf("error starting mongo session :: %v", e)
 	}
+	id := atomic.AddUint64(&c.nextSessionID, 1)
+	return &PooledSession{Session: session, id: id}, nil
+}
 
-	e = c.validate(client)
-	if e != nil {
-		return fmt.Errorf("error at creating the connection pool :: %v", e)
+// CheckIn ends the session returned by Checkout/CheckoutContext, releasing it back to the driver
+// and freeing its slot for the next Checkout/CheckoutContext call.
+func (c *ConnPool) CheckIn(ctx context.Context, session *PooledSession) {
+	session.EndSession(ctx)
+	c.releaseSlot()
+}
+
+// ErrPoolExhausted is returned by Checkout when poolSize sessions are already checked out.
+var ErrPoolExhausted = fmt.Errorf("connection pool exhausted")
+
+// acquireSlot reserves one of poolSize concurrent-session slots. If none are free and block is
+// false, it fails immediately with ErrPoolExhausted. If block is true, it queues the caller as a
+// FIFO waiter and blocks until a slot is handed to it by releaseSlot, or ctx is done.
+func (c *ConnPool) acquireSlot(ctx context.Context, block bool) error {
+	c.lock.Lock()
+	if c.inUse < c.poolSize {
+		c.inUse++
+		c.lock.Unlock()
+		return nil
 	}
+	if !block {
+		c.lock.Unlock()
+		return ErrPoolExhausted
+	}
+
+	ch := make(chan struct{}, 1)
+	c.waiters = append(c.waiters, ch)
+	c.waitCount++
+	start := time.Now()
+	c.lock.Unlock()
+
+	select {
+	case <-ch:
+		c.lock.Lock()
+		c.waitDuration += time.Since(start)
+		c.lock.Unlock()
+		return nil
+	case <-ctx.Done():
+		c.lock.Lock()
+		c.waitDuration += time.Since(start)
+		c.lock.Unlock()
+		c.abandonWaiter(ch)
+		return ctx.Err()
+	}
+}
+
+// releaseSlot frees one in-use slot. If a waiter is queued, the slot is handed directly to the
+// longest-waiting one instead of just being marked free, preserving FIFO order.
+func (c *ConnPool) releaseSlot() {
+	c.lock.Lock()
+	if len(c.waiters) > 0 {
+		next := c.waiters[0]
+		c.waiters = c.waiters[1:]
+		c.lock.Unlock()
+		next <- struct{}{}
+		return
+	}
+	c.inUse--
+	c.lock.Unlock()
+}
+
+// abandonWaiter removes ch from the waiter queue when its caller gave up (ctx done) before being
+// handed a slot. If releaseSlot already popped ch off the queue, ch won't be found here; that pop
+// guarantees releaseSlot will send on ch (it sends unconditionally right after popping, never
+// under the lock), so this blocks for that handoff and passes the slot on to the next waiter
+// instead of leaving it stranded in the abandoned channel.
+func (c *ConnPool) abandonWaiter(ch chan struct{}) {
+	c.lock.Lock()
+	for i, w := range c.waiters {
+		if w == ch {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			c.lock.Unlock()
+			return
+		}
+	}
+	c.lock.Unlock()
+
+	<-ch
+	c.releaseSlot()
+}
+
+// validate checks client liveness with a real Ping rather than calling Connect a second time,
+// since Connect is only meant to be called once per client lifetime and errors on a repeat call.
+func (c *ConnPool) validate(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.ValidationTimeout)
+	defer cancel()
 
-	customClient := clientWithCreation{
-		db:           client,
-		creationTime: time.Now().UnixNano(),
+	if err := c.currentClient().Ping(ctx, readpref.Primary()); err != nil {
+		return fmt.Errorf("error pinging mongo :: %v", err)
 	}
-	hash := c.hash(*client)
-	c.freeConnections[hash] = customClient
 	return nil
 }
+
+// SetHealthCheckInterval opts into a background goroutine that pings the client on the given
+// interval and records the result, observable via Healthy. Passing zero stops any running check.
+func (c *ConnPool) SetHealthCheckInterval(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.healthCheckStop != nil {
+		close(c.healthCheckStop)
+		c.healthCheckStop = nil
+	}
+
+	c.healthCheckInterval = d
+	if d <= 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+	c.healthCheckStop = stop
+	go c.healthCheckLoop(d, stop)
+}
+
+func (c *ConnPool) healthCheckLoop(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := c.validate(context.Background())
+			c.lock.Lock()
+			c.lastHealthCheckErr = err
+			c.lock.Unlock()
+		}
+	}
+}
+
+// Healthy reports whether the most recent health check Ping succeeded. It returns true if
+// SetHealthCheckInterval has never been called, since no failure has been observed.
+func (c *ConnPool) Healthy() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lastHealthCheckErr == nil
+}
+
+// Close stops the background reaper and health check goroutines and disconnects the shared
+// client. The pool must not be used after Close returns.
+func (c *ConnPool) Close(ctx context.Context) error {
+	c.lock.Lock()
+	if c.reapStop != nil {
+		close(c.reapStop)
+		c.reapStop = nil
+	}
+	if c.healthCheckStop != nil {
+		close(c.healthCheckStop)
+		c.healthCheckStop = nil
+	}
+	client := c.client
+	c.lock.Unlock()
+
+	return client.Disconnect(ctx)
+}
+
+// idle computes PoolStats.Idle, clamped to zero since poolSize can be shrunk below inUse by
+// SetMaxOpenConns while sessions are still checked out.
+func (c *ConnPool) idle() int {
+	if d := c.poolSize - c.inUse; d > 0 {
+		return d
+	}
+	return 0
+}
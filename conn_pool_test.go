@@ -0,0 +1,122 @@
+package mongo_go_driver_connection_pool
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAcquireSlotNonBlockingExhausted(t *testing.T) {
+	c := &ConnPool{poolSize: 1}
+
+	if err := c.acquireSlot(context.Background(), false); err != nil {
+		t.Fatalf("first acquireSlot: unexpected error %v", err)
+	}
+	if err := c.acquireSlot(context.Background(), false); err != ErrPoolExhausted {
+		t.Fatalf("second acquireSlot: got %v, want ErrPoolExhausted", err)
+	}
+}
+
+func TestReleaseSlotHandsOffToWaiter(t *testing.T) {
+	c := &ConnPool{poolSize: 1}
+
+	if err := c.acquireSlot(context.Background(), false); err != nil {
+		t.Fatalf("acquireSlot: unexpected error %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.acquireSlot(context.Background(), true)
+	}()
+
+	// give the waiter goroutine time to enqueue before releasing
+	time.Sleep(10 * time.Millisecond)
+	c.releaseSlot()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("blocked acquireSlot: unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked acquireSlot never unblocked")
+	}
+
+	if c.inUse != 1 {
+		t.Fatalf("inUse = %d, want 1", c.inUse)
+	}
+}
+
+func TestAcquireSlotContextCancelled(t *testing.T) {
+	c := &ConnPool{poolSize: 1}
+	if err := c.acquireSlot(context.Background(), false); err != nil {
+		t.Fatalf("acquireSlot: unexpected error %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := c.acquireSlot(ctx, true); err != ctx.Err() {
+		t.Fatalf("acquireSlot: got %v, want %v", err, ctx.Err())
+	}
+	if len(c.waiters) != 0 {
+		t.Fatalf("waiters = %d, want 0 after abandon", len(c.waiters))
+	}
+}
+
+func TestAbandonWaiterAfterHandoff(t *testing.T) {
+	c := &ConnPool{poolSize: 1}
+	if err := c.acquireSlot(context.Background(), false); err != nil {
+		t.Fatalf("acquireSlot: unexpected error %v", err)
+	}
+
+	// Simulate releaseSlot having already popped ch from the queue and sent on it, before the
+	// waiter gave up: this is the race abandonWaiter must handle without leaking the slot.
+	ch := make(chan struct{}, 1)
+	c.waiters = append(c.waiters, ch)
+	c.lock.Lock()
+	c.waiters = c.waiters[1:]
+	c.lock.Unlock()
+	ch <- struct{}{}
+
+	done := make(chan struct{})
+	go func() {
+		c.abandonWaiter(ch)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("abandonWaiter never returned: slot handoff was lost")
+	}
+
+	if c.inUse != 0 {
+		t.Fatalf("inUse = %d, want 0: abandoned handoff should free the slot", c.inUse)
+	}
+}
+
+func TestIdleClampedAtZero(t *testing.T) {
+	c := &ConnPool{poolSize: 2, inUse: 5}
+	if got := c.idle(); got != 0 {
+		t.Fatalf("idle() = %d, want 0 when inUse exceeds a shrunk poolSize", got)
+	}
+}
+
+func TestWithPoolSizeParams(t *testing.T) {
+	cases := []struct {
+		connStr     string
+		maxPoolSize int
+		maxIdleTime time.Duration
+		want        string
+	}{
+		{"mongodb://localhost:27017/db", 5, 0, "mongodb://localhost:27017/db?maxPoolSize=5"},
+		{"mongodb://localhost:27017/db?replicaSet=rs0", 5, 0, "mongodb://localhost:27017/db?replicaSet=rs0&maxPoolSize=5"},
+		{"mongodb://localhost:27017/db", 5, 30 * time.Second, "mongodb://localhost:27017/db?maxPoolSize=5&maxIdleTimeMS=30000"},
+	}
+	for _, tc := range cases {
+		if got := withPoolSizeParams(tc.connStr, tc.maxPoolSize, tc.maxIdleTime); got != tc.want {
+			t.Errorf("withPoolSizeParams(%q, %d, %v) = %q, want %q", tc.connStr, tc.maxPoolSize, tc.maxIdleTime, got, tc.want)
+		}
+	}
+}